@@ -0,0 +1,185 @@
+// Package cluster shards a single roshi CRDT cluster across N Redis
+// instances. Each logical key is backed by two physical sorted sets, one for
+// inserts and one for deletes (tombstones); a member is considered present
+// if its insert score is the higher of the two. Farm layers quorum,
+// cross-cluster repair, and CRDT merge-by-highest-score on top of multiple
+// Clusters.
+package cluster
+
+import (
+	"context"
+	"crypto/tls"
+	"hash/crc32"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/soundcloud/roshi/common"
+	"github.com/soundcloud/roshi/pool"
+)
+
+const (
+	insertSuffix = ":i"
+	deleteSuffix = ":d"
+)
+
+// addIfGreater is a Lua script implementing the CRDT merge rule: a
+// (member, score) pair only overwrites what's stored if its score is
+// strictly greater than the member's current score in the set.
+var addIfGreater = redis.NewScript(1, `
+	local current = redis.call('ZSCORE', KEYS[1], ARGV[2])
+	if current == false or tonumber(ARGV[1]) > tonumber(current) then
+		redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+	end
+	return 1
+`)
+
+// Cluster is a set of Redis instances that Farm treats as a single unit of
+// quorum and repair. Every method takes a context.Context and is expected to
+// give up on a Redis pool checkout as soon as that context is done, rather
+// than leaving a caller blocked on an exhausted pool. In the Cluster returned
+// by New, a Redis round-trip that has already started is bounded by the read
+// and write timeouts, not by the context.
+type Cluster interface {
+	Insert(ctx context.Context, tuples []common.KeyScoreMember) error
+	Delete(ctx context.Context, tuples []common.KeyScoreMember) error
+	Select(ctx context.Context, keys []string, offset, limit int) (map[string][]common.KeyScoreMember, error)
+	Score(ctx context.Context, key, member string) (score float64, wasInserted bool, err error)
+}
+
+// shardedCluster shards reads and writes for a set of keys across a fixed
+// set of Redis instance pools, chosen by hashing the key.
+type shardedCluster struct {
+	pools []*pool.Pool
+}
+
+// New returns a Cluster sharding across the given Redis addresses. Each
+// address gets its own pool of up to maxConnections connections with the
+// given timeouts. tlsConfig and password are both optional, and configure
+// how every connection in the cluster is dialed and authenticated; they let
+// Cluster run against managed Redis offerings (e.g. ElastiCache in-transit
+// encryption, Redis Enterprise Cloud) that require TLS and/or AUTH.
+func New(
+	addresses []string,
+	maxConnections int,
+	connectTimeout, readTimeout, writeTimeout time.Duration,
+	tlsConfig *tls.Config,
+	password string,
+) Cluster {
+	pools := make([]*pool.Pool, len(addresses))
+	for i, addr := range addresses {
+		pools[i] = pool.New(addr, maxConnections, connectTimeout, readTimeout, writeTimeout, tlsConfig, password)
+	}
+	return &shardedCluster{pools: pools}
+}
+
+func (c *shardedCluster) poolFor(key string) *pool.Pool {
+	return c.pools[crc32.ChecksumIEEE([]byte(key))%uint32(len(c.pools))]
+}
+
+// Insert adds each tuple's member to its key's insert set at the given
+// score, if that score is greater than what's already stored for that
+// member.
+func (c *shardedCluster) Insert(ctx context.Context, tuples []common.KeyScoreMember) error {
+	return c.apply(ctx, tuples, insertSuffix)
+}
+
+// Delete adds each tuple's member to its key's delete set (the tombstone
+// set) at the given score, if that score is greater than what's already
+// stored for that member.
+func (c *shardedCluster) Delete(ctx context.Context, tuples []common.KeyScoreMember) error {
+	return c.apply(ctx, tuples, deleteSuffix)
+}
+
+func (c *shardedCluster) apply(ctx context.Context, tuples []common.KeyScoreMember, suffix string) error {
+	for _, t := range tuples {
+		conn, err := c.poolFor(t.Key).Get(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = addIfGreater.Do(conn, t.Key+suffix, t.Score, t.Member)
+		conn.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Select returns, for each key, the highest-scoring limit members (after
+// skipping offset) whose insert score beats their delete score.
+func (c *shardedCluster) Select(ctx context.Context, keys []string, offset, limit int) (map[string][]common.KeyScoreMember, error) {
+	response := make(map[string][]common.KeyScoreMember, len(keys))
+	for _, key := range keys {
+		tuples, err := c.selectOne(ctx, key, offset, limit)
+		if err != nil {
+			return nil, err
+		}
+		response[key] = tuples
+	}
+	return response, nil
+}
+
+func (c *shardedCluster) selectOne(ctx context.Context, key string, offset, limit int) ([]common.KeyScoreMember, error) {
+	conn, err := c.poolFor(key).Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	inserts, err := redis.StringMap(conn.Do("ZREVRANGE", key+insertSuffix, 0, -1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	deletes, err := redis.Float64Map(conn.Do("ZREVRANGE", key+deleteSuffix, 0, -1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+
+	tuples := make(common.KeyScoreMembers, 0, len(inserts))
+	for member, scoreStr := range inserts {
+		score, err := redis.Float64(scoreStr, nil)
+		if err != nil {
+			return nil, err
+		}
+		if deleteScore, deleted := deletes[member]; deleted && deleteScore >= score {
+			continue
+		}
+		tuples = append(tuples, common.KeyScoreMember{Key: key, Score: score, Member: member})
+	}
+
+	sortedTuples := tuples
+	sort.Sort(sortedTuples)
+	if offset > len(sortedTuples) {
+		offset = len(sortedTuples)
+	}
+	sortedTuples = sortedTuples[offset:]
+	if limit < len(sortedTuples) {
+		sortedTuples = sortedTuples[:limit]
+	}
+	return sortedTuples, nil
+}
+
+// Score returns the highest of the member's insert and delete score for
+// key, and whether that highest score came from the insert set. If the
+// member is present in neither set, it returns a zero score and no error.
+func (c *shardedCluster) Score(ctx context.Context, key, member string) (score float64, wasInserted bool, err error) {
+	conn, err := c.poolFor(key).Get(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	defer conn.Close()
+
+	insertScore, err := redis.Float64(conn.Do("ZSCORE", key+insertSuffix, member))
+	if err != nil && err != redis.ErrNil {
+		return 0, false, err
+	}
+	deleteScore, err := redis.Float64(conn.Do("ZSCORE", key+deleteSuffix, member))
+	if err != nil && err != redis.ErrNil {
+		return 0, false, err
+	}
+	if insertScore >= deleteScore {
+		return insertScore, true, nil
+	}
+	return deleteScore, false, nil
+}
@@ -0,0 +1,112 @@
+// Command roshi-server exposes a Farm over HTTP.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/soundcloud/roshi/cluster"
+	"github.com/soundcloud/roshi/farm"
+)
+
+func main() {
+	var (
+		addrsFlag             = flag.String("redis.addrs", "localhost:6379", "comma-separated list of Redis instance addresses per cluster")
+		maxConnections        = flag.Int("redis.connections", 10, "maximum connections per Redis instance")
+		connectTimeout        = flag.Duration("redis.timeout.connect", 3*time.Second, "Redis connect timeout")
+		readTimeout           = flag.Duration("redis.timeout.read", time.Second, "Redis read timeout")
+		writeTimeout          = flag.Duration("redis.timeout.write", time.Second, "Redis write timeout")
+		redisPassword         = flag.String("redis.password", "", "AUTH password for every Redis instance, if any")
+		tlsCA                 = flag.String("redis.tls.ca", "", "path to a PEM CA bundle to verify Redis server certificates against")
+		tlsCert               = flag.String("redis.tls.cert", "", "path to a PEM client certificate for Redis TLS connections")
+		tlsKey                = flag.String("redis.tls.key", "", "path to the PEM key for -redis.tls.cert")
+		tlsInsecureSkipVerify = flag.Bool("redis.tls.insecure-skip-verify", false, "skip verification of Redis server certificates (testing only)")
+		httpAddr              = flag.String("http.addr", ":6302", "HTTP listen address")
+	)
+	flag.Parse()
+
+	tlsConfig, err := buildTLSConfig(*tlsCA, *tlsCert, *tlsKey, *tlsInsecureSkipVerify)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	c := cluster.New(
+		strings.Split(*addrsFlag, ","),
+		*maxConnections,
+		*connectTimeout, *readTimeout, *writeTimeout,
+		tlsConfig,
+		*redisPassword,
+	)
+
+	f := farm.New(
+		[]cluster.Cluster{c},
+		1,
+		farm.SendAllReadAll,
+		farm.SendAllRepair,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+
+	http.HandleFunc("/select", func(w http.ResponseWriter, r *http.Request) {
+		// Deriving ctx from the request means a client disconnect cancels it,
+		// which Farm propagates all the way down to its Redis pool checkouts.
+		ctx := r.Context()
+		keys, ok := r.URL.Query()["key"]
+		if !ok {
+			http.Error(w, "missing key parameter", http.StatusBadRequest)
+			return
+		}
+		result, err := f.Select(ctx, keys, 0, 100)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "%v\n", result)
+	})
+
+	log.Fatal(http.ListenAndServe(*httpAddr, nil))
+}
+
+// buildTLSConfig returns nil (plain TCP to Redis) if none of the -redis.tls.*
+// flags are set. Otherwise it builds a *tls.Config from them: caPath, if
+// given, restricts the trusted roots to that CA bundle instead of the
+// system's; certPath/keyPath, if given, present a client certificate for
+// Redis servers configured to require one.
+func buildTLSConfig(caPath, certPath, keyPath string, insecureSkipVerify bool) (*tls.Config, error) {
+	if caPath == "" && certPath == "" && keyPath == "" && !insecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+
+	if caPath != "" {
+		pem, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if certPath != "" || keyPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,19 @@
+// Package common provides types shared by the farm, cluster, and pool
+// packages.
+package common
+
+// KeyScoreMember is a single CRDT tuple: a member of a Farm zset key, with
+// the score it was inserted or deleted at.
+type KeyScoreMember struct {
+	Key    string
+	Score  float64
+	Member string
+}
+
+// KeyScoreMembers implements sort.Interface, ordering by descending score so
+// the highest-scoring (most recent) tuples sort first.
+type KeyScoreMembers []KeyScoreMember
+
+func (a KeyScoreMembers) Len() int           { return len(a) }
+func (a KeyScoreMembers) Less(i, j int) bool { return a[i].Score > a[j].Score }
+func (a KeyScoreMembers) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
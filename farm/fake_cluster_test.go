@@ -0,0 +1,30 @@
+package farm
+
+import (
+	"context"
+
+	"github.com/soundcloud/roshi/common"
+)
+
+// fakeCluster is a minimal cluster.Cluster double for tests that only care
+// about cluster identity (for routing and topology bookkeeping), not actual
+// Redis behavior. Its name exists purely to make test failures readable.
+type fakeCluster struct {
+	name string
+}
+
+func (c *fakeCluster) Insert(ctx context.Context, tuples []common.KeyScoreMember) error {
+	return nil
+}
+
+func (c *fakeCluster) Delete(ctx context.Context, tuples []common.KeyScoreMember) error {
+	return nil
+}
+
+func (c *fakeCluster) Select(ctx context.Context, keys []string, offset, limit int) (map[string][]common.KeyScoreMember, error) {
+	return map[string][]common.KeyScoreMember{}, nil
+}
+
+func (c *fakeCluster) Score(ctx context.Context, key, member string) (float64, bool, error) {
+	return 0, false, nil
+}
@@ -2,10 +2,12 @@
 package farm
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/soundcloud/roshi/cluster"
@@ -19,11 +21,36 @@ func init() {
 
 // Farm implements CRDT-semantic ZSET methods over many clusters.
 type Farm struct {
-	clusters        []cluster.Cluster
+	// clustersMu guards clusters, which can change after construction when a
+	// TopologyProvider is in use. Every write, read, and repair takes a
+	// snapshot of clusters at the start of the call and operates on that
+	// snapshot throughout, so a topology change mid-call can't change the
+	// set of clusters a given write/read/repair needs quorum or agreement
+	// from.
+	clustersMu sync.RWMutex
+	clusters   []cluster.Cluster
+
 	writeQuorum     int
 	readStrategy    coreReadStrategy
 	repairStrategy  repairStrategy
 	instrumentation instrumentation.Instrumentation
+
+	// latencyMu guards latencyEWMA, the per-cluster exponentially weighted
+	// moving average of Select round-trip time that RouteByLatency uses to
+	// rank clusters. Keyed by cluster rather than position so entries
+	// survive clusters being added or removed.
+	latencyMu   sync.Mutex
+	latencyEWMA map[cluster.Cluster]float64
+
+	// repairScheduler bounds how many repairOne calls run concurrently; see
+	// Repair and RepairScheduler.
+	repairScheduler *RepairScheduler
+
+	// topology, if non-nil, lets the set of backing clusters change after
+	// construction; see TopologyProvider.
+	topology        TopologyProvider
+	onNewCluster    func(cluster.Cluster)
+	onRemoveCluster func(cluster.Cluster)
 }
 
 // New creates and returns a new Farm.
@@ -34,12 +61,34 @@ type Farm struct {
 // passed ReadStrategy.
 //
 // Instrumentation may be nil; all other parameters are required.
+//
+// Every cluster.Cluster passed in is expected to accept a context.Context on
+// its Insert, Delete, Select, and Score methods, and to give up on a Redis
+// pool checkout as soon as that context is done. roshi-server is expected to
+// derive a per-request context (from the incoming HTTP request) and pass it
+// through to Farm so that a client disconnect unblocks the whole call chain.
+//
+// How each cluster.Cluster dials its Redis instances — including whether it
+// uses TLS or AUTH — is opaque to and independent of Farm; see the cluster
+// and pool packages.
+//
+// topology is optional. If non-nil, its Clusters method is consulted once,
+// at construction, to establish Farm's initial cluster set (falling back to
+// the clusters argument if that call fails); after that Farm subscribes to
+// the provider and adds or removes clusters as it emits TopologyEvents,
+// instead of keeping the set fixed. onNewCluster and onRemoveCluster, also
+// optional, are called after a cluster has been added to or removed from
+// Farm's rotation, and are a convenient place to wire up instrumentation,
+// warmup pings, or connection reuse.
 func New(
 	clusters []cluster.Cluster,
 	writeQuorum int,
 	readStrategy ReadStrategy,
 	repairStrategy repairStrategy,
 	instr instrumentation.Instrumentation,
+	topology TopologyProvider,
+	onNewCluster func(cluster.Cluster),
+	onRemoveCluster func(cluster.Cluster),
 ) *Farm {
 	if instr == nil {
 		instr = instrumentation.NopInstrumentation{}
@@ -49,74 +98,146 @@ func New(
 		writeQuorum:     writeQuorum,
 		repairStrategy:  repairStrategy,
 		instrumentation: instr,
+		latencyEWMA:     make(map[cluster.Cluster]float64, len(clusters)),
+		topology:        topology,
+		onNewCluster:    onNewCluster,
+		onRemoveCluster: onRemoveCluster,
 	}
 	farm.readStrategy = readStrategy(farm)
+	farm.repairScheduler = NewRepairScheduler(farm, defaultRepairWorkers, defaultRepairQueueSize, instr)
+	if topology != nil {
+		// If the provider can't give us an initial list, fall back to
+		// whatever was passed in via clusters rather than starting empty.
+		if initial, err := topology.Clusters(context.Background()); err == nil {
+			farm.clusters = initial
+		}
+		farm.watchTopology()
+	}
 	return farm
 }
 
+// currentClusters returns a snapshot of the clusters Farm currently knows
+// about. Callers take this snapshot once per write, read, or repair and
+// operate on it for the rest of that call, so a concurrent topology change
+// can't shift the set of clusters partway through.
+func (f *Farm) currentClusters() []cluster.Cluster {
+	f.clustersMu.RLock()
+	defer f.clustersMu.RUnlock()
+	clusters := make([]cluster.Cluster, len(f.clusters))
+	copy(clusters, f.clusters)
+	return clusters
+}
+
 // Insert adds each tuple into each underlying cluster, if the scores are
 // greater than the already-stored scores. As long as over half of the clusters
 // succeed to write all tuples, the overall write succeeds.
-func (f *Farm) Insert(tuples []common.KeyScoreMember) error {
+//
+// The passed context bounds the whole call: once it's canceled or its
+// deadline expires, Insert stops waiting on outstanding clusters and returns
+// ctx.Err() immediately, even if quorum could still theoretically be reached.
+func (f *Farm) Insert(ctx context.Context, tuples []common.KeyScoreMember) error {
 	return f.write(
+		ctx,
 		tuples,
-		func(c cluster.Cluster, a []common.KeyScoreMember) error { return c.Insert(a) },
+		func(ctx context.Context, c cluster.Cluster, a []common.KeyScoreMember) error { return c.Insert(ctx, a) },
 		insertInstrumentation{f.instrumentation},
 	)
 }
 
 // Selecter defines a synchronous Select API, implemented by Farm.
 type Selecter interface {
-	Select(keys []string, offset, limit int) (map[string][]common.KeyScoreMember, error)
+	Select(ctx context.Context, keys []string, offset, limit int) (map[string][]common.KeyScoreMember, error)
 }
 
-// Select invokes the ReadStrategy of the farm.
-func (f *Farm) Select(keys []string, offset, limit int) (map[string][]common.KeyScoreMember, error) {
+// Select invokes the ReadStrategy of the farm. The passed context is threaded
+// down into every cluster round-trip the strategy makes, and is honored even
+// when a slow cluster would otherwise keep the caller waiting.
+func (f *Farm) Select(ctx context.Context, keys []string, offset, limit int) (map[string][]common.KeyScoreMember, error) {
 	// High performance optimization.
 	if len(keys) <= 0 {
 		return map[string][]common.KeyScoreMember{}, nil
 	}
-	return f.readStrategy(keys, offset, limit)
+	return f.readStrategy(ctx, keys, offset, limit)
 }
 
 // Delete removes each tuple from the underlying clusters, if the score is
 // greater than the already-stored scores.
-func (f *Farm) Delete(tuples []common.KeyScoreMember) error {
+//
+// See the documentation on Insert for how ctx bounds this call.
+func (f *Farm) Delete(ctx context.Context, tuples []common.KeyScoreMember) error {
 	return f.write(
+		ctx,
 		tuples,
-		func(c cluster.Cluster, a []common.KeyScoreMember) error { return c.Delete(a) },
+		func(ctx context.Context, c cluster.Cluster, a []common.KeyScoreMember) error { return c.Delete(ctx, a) },
 		deleteInstrumentation{f.instrumentation},
 	)
 }
 
-// Repair queries all clusters for the most recent score for the given
+// Repair schedules km for repair on f.repairScheduler. It returns
+// immediately: the keyMember is deduplicated against jobs already queued or
+// in flight, and silently discarded (counted via the instrumentation's
+// RepairDiscarded counter) if the scheduler's queue is full, so that a burst
+// of repairs from a read strategy or the walker can't spin up unbounded
+// concurrent Redis operations.
+//
+// ctx is only used to skip scheduling a repair that's already moot (the
+// caller gave up before we even got to enqueue it); it is not carried into
+// the job itself. The actual repair runs later, on a scheduler worker,
+// detached from ctx, so a repair queued behind a burst of others isn't
+// abandoned just because the request that noticed the disagreement has
+// since moved on.
+func (f *Farm) Repair(ctx context.Context, km keyMember) {
+	if ctx.Err() != nil {
+		return
+	}
+	f.repairScheduler.Enqueue(km)
+}
+
+// repairOne queries all clusters for the most recent score for the given
 // keyMember taking both, the deletes key and the inserts key, into
 // account. It then propagates that score and if it was connected to
 // the deletes or the inserts key to all clusters that are not up to
 // date already.
-func (f *Farm) Repair(km keyMember) {
+//
+// If ctx is canceled or its deadline expires while the scatter/gather is in
+// flight, repairOne stops waiting for outstanding Score responses. The
+// propagation writes are also passed ctx, and repairOne waits for each of
+// them to return. An abandoned repair is not retried by the scheduler; the
+// keyMember is repaired again only if it is enqueued again. Workers
+// call repairOne with a bounded timeout rather than context.Background, so a
+// job stuck on an unresponsive cluster doesn't block its worker, and so the
+// keyMember it was given, forever.
+func (f *Farm) repairOne(ctx context.Context, km keyMember) {
 	go func() {
 		f.instrumentation.RepairCall()
 		f.instrumentation.RepairRequestCount(1)
 	}()
 
 	began := time.Now()
+	clusters := f.currentClusters()
 	clustersUpToDate := map[int]bool{}
 	highestScore := 0.
 	var wasInserted bool // Whether the highest scoring keyMember was inserted or deleted.
 
 	// Scatter.
-	responsesChan := make(chan scoreResponseTuple, len(f.clusters))
-	for i, c := range f.clusters {
+	responsesChan := make(chan scoreResponseTuple, len(clusters))
+	for i, c := range clusters {
 		go func(i int, c cluster.Cluster) {
-			score, wasInserted, err := c.Score(km.Key, km.Member)
+			score, wasInserted, err := c.Score(ctx, km.Key, km.Member)
 			responsesChan <- scoreResponseTuple{i, score, wasInserted, err}
 		}(i, c)
 	}
 
 	// Gather.
+gather:
 	for i := 0; i < cap(responsesChan); i++ {
-		resp := <-responsesChan
+		var resp scoreResponseTuple
+		select {
+		case resp = <-responsesChan:
+		case <-ctx.Done():
+			f.instrumentation.RepairCheckPartialFailure()
+			break gather
+		}
 		if resp.err != nil {
 			f.instrumentation.RepairCheckPartialFailure()
 			continue
@@ -144,25 +265,31 @@ func (f *Farm) Repair(km keyMember) {
 		f.instrumentation.RepairCheckCompleteFailure()
 		return
 	}
-	if len(clustersUpToDate) == len(f.clusters) {
+	if len(clustersUpToDate) == len(clusters) {
 		// Cool. All clusters agree already. Done.
 		f.instrumentation.RepairCheckRedundant()
 		return
 	}
 	// We have a KeyScoreMember, and we have to propagate it to some clusters.
+	// We wait for every propagation write to finish before returning, so that
+	// by the time repairOne (and so RepairScheduler.Wait) returns, the writes
+	// have actually landed rather than merely having been started.
 	f.instrumentation.RepairWriteCount()
 	ksm := common.KeyScoreMember{Key: km.Key, Score: highestScore, Member: km.Member}
-	for i, c := range f.clusters {
+	var propagation sync.WaitGroup
+	for i, c := range clusters {
 		if !clustersUpToDate[i] {
+			propagation.Add(1)
 			go func(c cluster.Cluster) {
+				defer propagation.Done()
 				defer func(began time.Time) {
 					f.instrumentation.RepairWriteDuration(time.Now().Sub(began))
 				}(time.Now())
 				var err error
 				if wasInserted {
-					err = c.Insert([]common.KeyScoreMember{ksm})
+					err = c.Insert(ctx, []common.KeyScoreMember{ksm})
 				} else {
-					err = c.Delete([]common.KeyScoreMember{ksm})
+					err = c.Delete(ctx, []common.KeyScoreMember{ksm})
 				}
 				if err == nil {
 					f.instrumentation.RepairWriteSuccess()
@@ -172,11 +299,13 @@ func (f *Farm) Repair(km keyMember) {
 			}(c)
 		}
 	}
+	propagation.Wait()
 }
 
 func (f *Farm) write(
+	ctx context.Context,
 	tuples []common.KeyScoreMember,
-	action func(cluster.Cluster, []common.KeyScoreMember) error,
+	action func(context.Context, cluster.Cluster, []common.KeyScoreMember) error,
 	instr writeInstrumentation,
 ) error {
 	// High performance optimization.
@@ -192,24 +321,31 @@ func (f *Farm) write(
 	}(time.Now())
 
 	// Scatter
-	errChan := make(chan error, len(f.clusters))
-	for _, c := range f.clusters {
+	clusters := f.currentClusters()
+	errChan := make(chan error, len(clusters))
+	for _, c := range clusters {
 		go func(c cluster.Cluster) {
-			errChan <- action(c, tuples)
+			errChan <- action(ctx, c, tuples)
 		}(c)
 	}
 
 	// Gather
 	errors, got, need := []string{}, 0, f.writeQuorum
 	haveQuorum := func() bool { return got-len(errors) >= need }
+gather:
 	for i := 0; i < cap(errChan); i++ {
-		err := <-errChan
-		if err != nil {
-			errors = append(errors, err.Error())
-		}
-		got++
-		if haveQuorum() {
-			break
+		select {
+		case err := <-errChan:
+			if err != nil {
+				errors = append(errors, err.Error())
+			}
+			got++
+			if haveQuorum() {
+				break gather
+			}
+		case <-ctx.Done():
+			instr.quorumFailure()
+			return ctx.Err()
 		}
 	}
 
@@ -0,0 +1,179 @@
+package farm
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/soundcloud/roshi/cluster"
+	"github.com/soundcloud/roshi/common"
+)
+
+// explorationEpsilon is the probability that RouteByLatency swaps one of its
+// lowest-EWMA picks for a cluster drawn at random from the ones it didn't
+// pick, so a cluster whose EWMA is still high from an earlier slow patch (and
+// which would otherwise never be picked again) still gets re-probed every so
+// often.
+const explorationEpsilon = 0.1
+
+// RouteByLatency returns a ReadStrategy that, for each Select, queries only
+// the maxParallel clusters with the lowest exponentially weighted moving
+// average (EWMA) of recent Select round-trip time, instead of fanning out to
+// every cluster. decay is the EWMA smoothing factor in (0, 1]; values closer
+// to 1 weight the most recent round-trip more heavily. Like RouteRandomly,
+// unqueried clusters simply sit out that round's union and repair pipeline,
+// catching up the next time they're picked or visited by a walker.
+//
+// This mirrors the routing knobs found in other Redis cluster clients, and
+// lets operators trade read freshness for tail latency without provisioning
+// additional clusters.
+func RouteByLatency(maxParallel int, decay float64) ReadStrategy {
+	return func(f *Farm) coreReadStrategy {
+		return func(ctx context.Context, keys []string, offset, limit int) (map[string][]common.KeyScoreMember, error) {
+			clusters := f.lowestLatencyClusters(maxParallel)
+			return f.selectFrom(ctx, clusters, decay, keys, offset, limit)
+		}
+	}
+}
+
+// RouteRandomly returns a ReadStrategy that queries maxParallel clusters,
+// chosen uniformly at random, for each Select, instead of fanning out to
+// every cluster. See RouteByLatency for how the queried clusters still feed
+// the repair pipeline.
+func RouteRandomly(maxParallel int) ReadStrategy {
+	return func(f *Farm) coreReadStrategy {
+		return func(ctx context.Context, keys []string, offset, limit int) (map[string][]common.KeyScoreMember, error) {
+			clusters := randomClusters(f.currentClusters(), maxParallel)
+			return f.selectFrom(ctx, clusters, 0, keys, offset, limit)
+		}
+	}
+}
+
+// rankedCluster pairs a cluster with its current latency EWMA, for sorting
+// in lowestLatencyClusters.
+type rankedCluster struct {
+	cluster cluster.Cluster
+	latency float64
+}
+
+// lowestLatencyClusters returns up to n clusters, ranked by ascending
+// latencyEWMA, with an explorationEpsilon chance of substituting a random
+// cluster for one of the picks. Clusters with no recorded latency yet sort
+// first, so new or freshly re-added clusters are tried before being ranked.
+func (f *Farm) lowestLatencyClusters(n int) []cluster.Cluster {
+	clusters := f.currentClusters()
+
+	f.latencyMu.Lock()
+	ranked := make([]rankedCluster, len(clusters))
+	for i, c := range clusters {
+		ranked[i] = rankedCluster{c, f.latencyEWMA[c]}
+	}
+	f.latencyMu.Unlock()
+
+	sort.SliceStable(ranked, func(a, b int) bool { return ranked[a].latency < ranked[b].latency })
+
+	if n > len(ranked) {
+		n = len(ranked)
+	}
+	picked := make([]cluster.Cluster, n)
+	for i := 0; i < n; i++ {
+		picked[i] = ranked[i].cluster
+	}
+	if n > 0 && n < len(ranked) && rand.Float64() < explorationEpsilon {
+		picked[rand.Intn(len(picked))] = ranked[n+rand.Intn(len(ranked)-n)].cluster
+	}
+	return picked
+}
+
+// randomClusters returns n distinct clusters drawn uniformly at random from
+// clusters.
+func randomClusters(clusters []cluster.Cluster, n int) []cluster.Cluster {
+	if n > len(clusters) {
+		n = len(clusters)
+	}
+	perm := rand.Perm(len(clusters))
+	picked := make([]cluster.Cluster, n)
+	for i := 0; i < n; i++ {
+		picked[i] = clusters[perm[i]]
+	}
+	return picked
+}
+
+// recordLatency folds d into the EWMA tracked for c.
+func (f *Farm) recordLatency(c cluster.Cluster, d time.Duration, decay float64) {
+	f.latencyMu.Lock()
+	defer f.latencyMu.Unlock()
+	sample := float64(d)
+	if cur, ok := f.latencyEWMA[c]; ok {
+		f.latencyEWMA[c] = decay*sample + (1-decay)*cur
+		return
+	}
+	f.latencyEWMA[c] = sample
+}
+
+// clusterSelectResponse carries one cluster's Select result back to the
+// gather loop in selectFrom.
+type clusterSelectResponse struct {
+	cluster cluster.Cluster
+	result  map[string][]common.KeyScoreMember
+	err     error
+}
+
+// selectFrom scatters a Select across the given clusters, gathers responses
+// (abandoning outstanding ones as soon as ctx is done), unions the results
+// per key, and repairs any differences it finds. When decay is greater than
+// zero, each successful response's round-trip time is folded into that
+// cluster's latency EWMA.
+func (f *Farm) selectFrom(ctx context.Context, clusters []cluster.Cluster, decay float64, keys []string, offset, limit int) (map[string][]common.KeyScoreMember, error) {
+	responsesChan := make(chan clusterSelectResponse, len(clusters))
+	for _, c := range clusters {
+		go func(c cluster.Cluster) {
+			began := time.Now()
+			result, err := c.Select(ctx, keys, offset, limit)
+			if err == nil && decay > 0 {
+				f.recordLatency(c, time.Now().Sub(began), decay)
+			}
+			responsesChan <- clusterSelectResponse{c, result, err}
+		}(c)
+	}
+
+	tupleSets := make(map[string][]tupleSet, len(keys))
+	received := 0
+gather:
+	for received < cap(responsesChan) {
+		select {
+		case resp := <-responsesChan:
+			received++
+			if resp.err != nil {
+				continue
+			}
+			for _, key := range keys {
+				tupleSets[key] = append(tupleSets[key], makeSet(resp.result[key]))
+			}
+		case <-ctx.Done():
+			break gather
+		}
+	}
+
+	// If ctx was canceled before every cluster answered, tupleSets only holds
+	// a partial view of the clusters we queried: treating the gaps that
+	// leaves as disagreements and repairing them would just spawn repair
+	// work against clusters we never heard back from. Still return whatever
+	// partial result we gathered, but don't generate repairs from it.
+	cancelled := ctx.Err() != nil
+
+	response := make(map[string][]common.KeyScoreMember, len(keys))
+	for _, key := range keys {
+		union, difference := unionDifference(tupleSets[key])
+		// Each cluster has already skipped offset, so only limit applies here.
+		response[key] = union.orderedLimitedSlice(limit)
+		if cancelled {
+			continue
+		}
+		for km := range difference {
+			f.Repair(ctx, km)
+		}
+	}
+	return response, ctx.Err()
+}
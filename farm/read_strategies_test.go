@@ -0,0 +1,76 @@
+package farm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/soundcloud/roshi/cluster"
+)
+
+func TestLowestLatencyClustersRanksByEWMA(t *testing.T) {
+	a, b, c := &fakeCluster{"a"}, &fakeCluster{"b"}, &fakeCluster{"c"}
+	f := &Farm{
+		clusters:    []cluster.Cluster{a, b, c},
+		latencyEWMA: map[cluster.Cluster]float64{a: 30, b: 10, c: 20},
+	}
+
+	// n == len(clusters), so the exploration branch never fires: the result
+	// must be a straight ascending-EWMA ranking.
+	got := f.lowestLatencyClusters(3)
+	want := []cluster.Cluster{b, c, a}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("lowestLatencyClusters = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestLowestLatencyClustersUnseenSortFirst(t *testing.T) {
+	seen, unseen := &fakeCluster{"seen"}, &fakeCluster{"unseen"}
+	f := &Farm{
+		clusters:    []cluster.Cluster{seen, unseen},
+		latencyEWMA: map[cluster.Cluster]float64{seen: 50},
+	}
+
+	got := f.lowestLatencyClusters(2)
+	if got[0] != unseen {
+		t.Errorf("lowestLatencyClusters = %v, want unseen cluster first", got)
+	}
+}
+
+func TestRecordLatencyEWMA(t *testing.T) {
+	f := &Farm{latencyEWMA: map[cluster.Cluster]float64{}}
+	c := &fakeCluster{"x"}
+
+	f.recordLatency(c, 100*time.Millisecond, 0.5)
+	if got, want := f.latencyEWMA[c], float64(100*time.Millisecond); got != want {
+		t.Errorf("first sample EWMA = %v, want %v", got, want)
+	}
+
+	f.recordLatency(c, 300*time.Millisecond, 0.5)
+	want := 0.5*float64(300*time.Millisecond) + 0.5*float64(100*time.Millisecond)
+	if got := f.latencyEWMA[c]; got != want {
+		t.Errorf("second sample EWMA = %v, want %v", got, want)
+	}
+}
+
+func TestRandomClustersDistinctAndSized(t *testing.T) {
+	clusters := []cluster.Cluster{&fakeCluster{"a"}, &fakeCluster{"b"}, &fakeCluster{"c"}}
+
+	picked := randomClusters(clusters, 2)
+	if len(picked) != 2 {
+		t.Fatalf("randomClusters returned %d clusters, want 2", len(picked))
+	}
+	if picked[0] == picked[1] {
+		t.Errorf("randomClusters returned the same cluster twice: %v", picked)
+	}
+}
+
+func TestRandomClustersClampsToAvailable(t *testing.T) {
+	clusters := []cluster.Cluster{&fakeCluster{"a"}}
+
+	picked := randomClusters(clusters, 5)
+	if len(picked) != 1 {
+		t.Errorf("randomClusters returned %d clusters, want 1 (only one available)", len(picked))
+	}
+}
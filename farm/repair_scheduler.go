@@ -0,0 +1,118 @@
+package farm
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/soundcloud/roshi/instrumentation"
+)
+
+// defaultRepairWorkers and defaultRepairQueueSize size the RepairScheduler
+// that New creates for every Farm. They're generous enough for normal
+// read-repair traffic while still bounding a repair storm to a known number
+// of concurrent Redis operations.
+const (
+	defaultRepairWorkers   = 64
+	defaultRepairQueueSize = 4096
+)
+
+// repairTimeout bounds how long a single worker will spend on one job.
+// Without a deadline, a job stuck on a slow or unreachable cluster ties up
+// its worker indefinitely, so every other queued keyMember waits behind it
+// even though the scheduler has plenty of workers in principle.
+const repairTimeout = 30 * time.Second
+
+// repairJob is one unit of work for a RepairScheduler.
+type repairJob struct {
+	km keyMember
+}
+
+// RepairScheduler bounds the number of repairs that run concurrently. It
+// owns a fixed pool of workers draining a bounded queue of keyMember jobs, so
+// that a repair storm (e.g. a read strategy or the walker scheduling
+// thousands of repairs at once) can't flood the clusters with unbounded
+// concurrent Redis operations.
+//
+// Jobs are deduplicated: a keyMember already queued or being repaired is not
+// queued again until its current repair completes. When the queue is full,
+// new jobs are dropped rather than blocking the caller, and counted via the
+// instrumentation's RepairDiscarded counter.
+type RepairScheduler struct {
+	farm *Farm
+	jobs chan repairJob
+
+	// pending tracks jobs that are queued or in flight, so Wait can block
+	// until the scheduler has drained everything submitted before the call.
+	pending sync.WaitGroup
+
+	mu       sync.Mutex
+	inFlight map[keyMember]struct{}
+
+	instrumentation instrumentation.Instrumentation
+}
+
+// NewRepairScheduler starts workers goroutines, each pulling keyMember jobs
+// off a queue of size queueSize and repairing them via farm.repairOne.
+// Instrumentation may be nil. Dropped jobs are counted via its
+// RepairDiscarded method.
+func NewRepairScheduler(farm *Farm, workers, queueSize int, instr instrumentation.Instrumentation) *RepairScheduler {
+	if instr == nil {
+		instr = instrumentation.NopInstrumentation{}
+	}
+	s := &RepairScheduler{
+		farm:            farm,
+		jobs:            make(chan repairJob, queueSize),
+		inFlight:        map[keyMember]struct{}{},
+		instrumentation: instr,
+	}
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	return s
+}
+
+// Enqueue schedules km for repair. It returns immediately: km is
+// deduplicated against jobs already queued or in flight, and dropped
+// (incrementing RepairDiscarded) if the queue is full. Enqueue takes no
+// context; see Farm.Repair for why.
+func (s *RepairScheduler) Enqueue(km keyMember) {
+	s.mu.Lock()
+	if _, ok := s.inFlight[km]; ok {
+		s.mu.Unlock()
+		return
+	}
+	s.inFlight[km] = struct{}{}
+	s.mu.Unlock()
+
+	s.pending.Add(1)
+	select {
+	case s.jobs <- repairJob{km}:
+	default:
+		s.pending.Done()
+		s.mu.Lock()
+		delete(s.inFlight, km)
+		s.mu.Unlock()
+		s.instrumentation.RepairDiscarded()
+	}
+}
+
+// Wait blocks until every job enqueued before the call has been repaired.
+// It's meant for tests that need repairs to settle before asserting on
+// cluster state; production callers should let the scheduler run in the
+// background.
+func (s *RepairScheduler) Wait() {
+	s.pending.Wait()
+}
+
+func (s *RepairScheduler) work() {
+	for job := range s.jobs {
+		ctx, cancel := context.WithTimeout(context.Background(), repairTimeout)
+		s.farm.repairOne(ctx, job.km)
+		cancel()
+		s.mu.Lock()
+		delete(s.inFlight, job.km)
+		s.mu.Unlock()
+		s.pending.Done()
+	}
+}
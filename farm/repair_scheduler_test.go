@@ -0,0 +1,71 @@
+package farm
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/soundcloud/roshi/cluster"
+	"github.com/soundcloud/roshi/instrumentation"
+)
+
+// countingInstrumentation counts RepairDiscarded calls; every other method
+// is a no-op.
+type countingInstrumentation struct {
+	instrumentation.NopInstrumentation
+	mu        sync.Mutex
+	discarded int
+}
+
+func (c *countingInstrumentation) RepairDiscarded() {
+	c.mu.Lock()
+	c.discarded++
+	c.mu.Unlock()
+}
+
+func TestRepairSchedulerEnqueueDedups(t *testing.T) {
+	// No workers, so nothing drains the queue and inFlight stays populated:
+	// the second Enqueue for the same keyMember must be a no-op.
+	s := NewRepairScheduler(nil, 0, 10, nil)
+	km := keyMember{Key: "k", Member: "m"}
+
+	s.Enqueue(km)
+	s.Enqueue(km)
+
+	if got, want := len(s.jobs), 1; got != want {
+		t.Errorf("queued jobs = %d, want %d (duplicate Enqueue should have been deduped)", got, want)
+	}
+}
+
+func TestRepairSchedulerEnqueueDropsWhenFull(t *testing.T) {
+	instr := &countingInstrumentation{}
+	s := NewRepairScheduler(nil, 0, 1, instr)
+
+	s.Enqueue(keyMember{Key: "a", Member: "1"})
+	s.Enqueue(keyMember{Key: "b", Member: "2"})
+
+	if got, want := len(s.jobs), 1; got != want {
+		t.Errorf("queued jobs = %d, want %d", got, want)
+	}
+	if got, want := instr.discarded, 1; got != want {
+		t.Errorf("RepairDiscarded called %d times, want %d", got, want)
+	}
+}
+
+func TestRepairSchedulerWaitBlocksUntilDrained(t *testing.T) {
+	f := &Farm{
+		clusters:        []cluster.Cluster{&fakeCluster{"a"}},
+		instrumentation: instrumentation.NopInstrumentation{},
+	}
+	s := NewRepairScheduler(f, 2, 10, nil)
+	f.repairScheduler = s
+
+	for i := 0; i < 5; i++ {
+		s.Enqueue(keyMember{Key: "k", Member: fmt.Sprintf("%d", i)})
+	}
+	s.Wait()
+
+	if got := len(s.jobs); got != 0 {
+		t.Errorf("jobs channel not drained after Wait: %d jobs left", got)
+	}
+}
@@ -0,0 +1,88 @@
+package farm
+
+import (
+	"context"
+
+	"github.com/soundcloud/roshi/cluster"
+)
+
+// TopologyProvider supplies Farm with a set of backing clusters that can
+// change after construction, so clusters can be added or drained without
+// restarting the process. This mirrors the ClusterSlots/OnNewNode-style
+// extension points grown by other Redis cluster clients, and lets roshi
+// participate in orchestrated environments (a Kubernetes StatefulSet scale
+// event, Consul-driven Redis membership) instead of requiring a restart
+// every time the backing clusters change.
+type TopologyProvider interface {
+	// Clusters returns the current set of backing clusters. Farm calls this
+	// once, at construction, to establish its initial topology.
+	Clusters(ctx context.Context) ([]cluster.Cluster, error)
+
+	// Subscribe registers events on the given channel as clusters are added
+	// to or removed from the topology. The provider owns the channel's
+	// lifetime and may send on it for as long as Farm is alive.
+	Subscribe(events chan<- TopologyEvent)
+}
+
+// TopologyEventType describes what happened to a cluster in a
+// TopologyProvider's topology.
+type TopologyEventType int
+
+// The possible TopologyEventType values.
+const (
+	ClusterAdded TopologyEventType = iota
+	ClusterRemoved
+)
+
+// TopologyEvent is sent by a TopologyProvider whenever a cluster joins or
+// leaves its topology.
+type TopologyEvent struct {
+	Type    TopologyEventType
+	Cluster cluster.Cluster
+}
+
+// watchTopology subscribes to f.topology and applies every event it sends
+// for the lifetime of the Farm. It must only be called when f.topology is
+// non-nil.
+func (f *Farm) watchTopology() {
+	events := make(chan TopologyEvent, 16)
+	f.topology.Subscribe(events)
+	go func() {
+		for event := range events {
+			f.applyTopologyEvent(event)
+		}
+	}()
+}
+
+// applyTopologyEvent adds or removes a single cluster from f.clusters,
+// taking clustersMu only for the duration of the swap so that in-flight
+// writes, reads, and repairs (which already hold their own snapshot via
+// currentClusters) drain against the topology they started with rather than
+// being disrupted by the change. The corresponding lifecycle callback, if
+// any, is invoked after the swap.
+func (f *Farm) applyTopologyEvent(event TopologyEvent) {
+	switch event.Type {
+	case ClusterAdded:
+		f.clustersMu.Lock()
+		f.clusters = append(f.clusters, event.Cluster)
+		f.clustersMu.Unlock()
+		if f.onNewCluster != nil {
+			f.onNewCluster(event.Cluster)
+		}
+	case ClusterRemoved:
+		f.clustersMu.Lock()
+		for i, c := range f.clusters {
+			if c == event.Cluster {
+				f.clusters = append(f.clusters[:i], f.clusters[i+1:]...)
+				break
+			}
+		}
+		f.clustersMu.Unlock()
+		f.latencyMu.Lock()
+		delete(f.latencyEWMA, event.Cluster)
+		f.latencyMu.Unlock()
+		if f.onRemoveCluster != nil {
+			f.onRemoveCluster(event.Cluster)
+		}
+	}
+}
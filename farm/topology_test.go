@@ -0,0 +1,47 @@
+package farm
+
+import (
+	"testing"
+
+	"github.com/soundcloud/roshi/cluster"
+)
+
+func TestApplyTopologyEventAdd(t *testing.T) {
+	var added cluster.Cluster
+	f := &Farm{
+		latencyEWMA:  map[cluster.Cluster]float64{},
+		onNewCluster: func(c cluster.Cluster) { added = c },
+	}
+	c := &fakeCluster{"new"}
+
+	f.applyTopologyEvent(TopologyEvent{Type: ClusterAdded, Cluster: c})
+
+	if len(f.clusters) != 1 || f.clusters[0] != c {
+		t.Fatalf("clusters = %v, want just the added cluster", f.clusters)
+	}
+	if added != c {
+		t.Errorf("onNewCluster was not invoked with the added cluster")
+	}
+}
+
+func TestApplyTopologyEventRemove(t *testing.T) {
+	keep, remove := &fakeCluster{"keep"}, &fakeCluster{"remove"}
+	var removed cluster.Cluster
+	f := &Farm{
+		clusters:        []cluster.Cluster{keep, remove},
+		latencyEWMA:     map[cluster.Cluster]float64{remove: 42},
+		onRemoveCluster: func(c cluster.Cluster) { removed = c },
+	}
+
+	f.applyTopologyEvent(TopologyEvent{Type: ClusterRemoved, Cluster: remove})
+
+	if len(f.clusters) != 1 || f.clusters[0] != keep {
+		t.Fatalf("clusters = %v, want just the kept cluster", f.clusters)
+	}
+	if _, ok := f.latencyEWMA[remove]; ok {
+		t.Errorf("latencyEWMA still has an entry for the removed cluster")
+	}
+	if removed != remove {
+		t.Errorf("onRemoveCluster was not invoked with the removed cluster")
+	}
+}
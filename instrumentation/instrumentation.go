@@ -0,0 +1,62 @@
+// Package instrumentation defines the callback surface Farm uses to report
+// counts and durations for its Insert, Delete, Select, and Repair
+// operations.
+package instrumentation
+
+import "time"
+
+// Instrumentation receives counts and durations for every Farm operation.
+// Implementations must be safe for concurrent use.
+type Instrumentation interface {
+	InsertCall()
+	InsertRecordCount(int)
+	InsertCallDuration(time.Duration)
+	InsertRecordDuration(time.Duration)
+	InsertQuorumFailure()
+
+	DeleteCall()
+	DeleteRecordCount(int)
+	DeleteCallDuration(time.Duration)
+	DeleteRecordDuration(time.Duration)
+	DeleteQuorumFailure()
+
+	RepairCall()
+	RepairRequestCount(int)
+	RepairCheckPartialFailure()
+	RepairCheckDuration(time.Duration)
+	RepairCheckCompleteFailure()
+	RepairCheckRedundant()
+	RepairWriteCount()
+	RepairWriteDuration(time.Duration)
+	RepairWriteSuccess()
+	RepairWriteFailure()
+	RepairDiscarded()
+}
+
+// NopInstrumentation implements Instrumentation by doing nothing. It's what
+// farm.New falls back to when no Instrumentation is given.
+type NopInstrumentation struct{}
+
+func (NopInstrumentation) InsertCall()                        {}
+func (NopInstrumentation) InsertRecordCount(int)              {}
+func (NopInstrumentation) InsertCallDuration(time.Duration)   {}
+func (NopInstrumentation) InsertRecordDuration(time.Duration) {}
+func (NopInstrumentation) InsertQuorumFailure()               {}
+
+func (NopInstrumentation) DeleteCall()                        {}
+func (NopInstrumentation) DeleteRecordCount(int)              {}
+func (NopInstrumentation) DeleteCallDuration(time.Duration)   {}
+func (NopInstrumentation) DeleteRecordDuration(time.Duration) {}
+func (NopInstrumentation) DeleteQuorumFailure()               {}
+
+func (NopInstrumentation) RepairCall()                       {}
+func (NopInstrumentation) RepairRequestCount(int)             {}
+func (NopInstrumentation) RepairCheckPartialFailure()         {}
+func (NopInstrumentation) RepairCheckDuration(time.Duration)  {}
+func (NopInstrumentation) RepairCheckCompleteFailure()        {}
+func (NopInstrumentation) RepairCheckRedundant()              {}
+func (NopInstrumentation) RepairWriteCount()                  {}
+func (NopInstrumentation) RepairWriteDuration(time.Duration)  {}
+func (NopInstrumentation) RepairWriteSuccess()                {}
+func (NopInstrumentation) RepairWriteFailure()                {}
+func (NopInstrumentation) RepairDiscarded()                   {}
@@ -0,0 +1,73 @@
+// Package pool provides a pooled connection to a single Redis instance, with
+// optional TLS and AUTH.
+package pool
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Pool is a connection pool for one Redis instance.
+type Pool struct {
+	redis *redis.Pool
+}
+
+// New returns a Pool of up to maxConnections connections to addr. If
+// tlsConfig is non-nil, connections are dialed via tls.Dial instead of plain
+// TCP. If password is non-empty, AUTH is issued on every new connection
+// before it's handed out, ahead of any other pipelined command.
+func New(addr string, maxConnections int, connectTimeout, readTimeout, writeTimeout time.Duration, tlsConfig *tls.Config, password string) *Pool {
+	return &Pool{
+		redis: &redis.Pool{
+			MaxActive: maxConnections,
+			MaxIdle:   maxConnections,
+			Wait:      true,
+			Dial: func() (redis.Conn, error) {
+				return dial(addr, connectTimeout, readTimeout, writeTimeout, tlsConfig, password)
+			},
+		},
+	}
+}
+
+// dial opens a connection to addr, over TLS when tlsConfig is non-nil, and
+// issues AUTH with password (if any) before the connection is used for
+// anything else.
+func dial(addr string, connectTimeout, readTimeout, writeTimeout time.Duration, tlsConfig *tls.Config, password string) (redis.Conn, error) {
+	var (
+		netConn net.Conn
+		err     error
+	)
+	if tlsConfig != nil {
+		netConn, err = tls.DialWithDialer(&net.Dialer{Timeout: connectTimeout}, "tcp", addr, tlsConfig)
+	} else {
+		netConn, err = net.DialTimeout("tcp", addr, connectTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn := redis.NewConn(netConn, readTimeout, writeTimeout)
+	if password != "" {
+		if _, err := conn.Do("AUTH", password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Get checks out a connection, blocking until ctx is done if the pool is
+// exhausted and Wait is set. A canceled or expired ctx unblocks the checkout
+// immediately with ctx.Err(), rather than leaving the caller waiting on a
+// connection that a slow or stuck Redis instance may never free up.
+func (p *Pool) Get(ctx context.Context) (redis.Conn, error) {
+	return p.redis.GetContext(ctx)
+}
+
+// Close closes the pool and all of its idle connections.
+func (p *Pool) Close() error {
+	return p.redis.Close()
+}